@@ -8,12 +8,14 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"encoding/hex"
 	"fmt"
 	"net"
 	"os"
 	"strings"
 	"time"
 
+	"github.com/caddyserver/certmagic"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 	minio "github.com/storj/minio/cmd"
@@ -23,6 +25,7 @@ import (
 	"storj.io/common/fpath"
 	"storj.io/common/rpc/rpcpool"
 	"storj.io/gateway-mt/miniogw"
+	"storj.io/gateway-mt/pkg/certstorage"
 	"storj.io/gateway-mt/pkg/server"
 	"storj.io/private/cfgstruct"
 	"storj.io/private/process"
@@ -40,9 +43,120 @@ type GatewayFlags struct {
 	InsecureDisableTLS bool   `help:"listen using insecure connections" releaseDefault:"false" devDefault:"true"`
 	DomainName         string `help:"comma-separated domain suffixes to serve on" releaseDefault:"" devDefault:"localhost" basic-help:"true"`
 
+	CertStorageURL            string `help:"certificate storage backend URL, e.g. gs://bucket/prefix or s3://bucket/prefix?endpoint=..." releaseDefault:"" devDefault:""`
+	CertStorageGCSJSONKeyPath string `help:"path to a GCS service account JSON key file, used when --certstorage-url is a gs:// URL" releaseDefault:"" devDefault:""`
+	CertStorageS3AccessKeyID  string `help:"access key ID, used when --certstorage-url is an s3:// URL" releaseDefault:"" devDefault:""`
+	CertStorageS3SecretKey    string `help:"secret access key, used when --certstorage-url is an s3:// URL" releaseDefault:"" devDefault:""`
+	CertStorageEncryptionKey  string `help:"hex-encoded 32-byte AES-256 key to encrypt certificate data written to a gs:// or s3:// --certstorage-url at rest (other schemes are not encrypted); leave empty to store it unencrypted" releaseDefault:"" devDefault:""`
+
+	CertStorageCacheTTL        time.Duration `help:"how long to cache --certstorage-url Load/Stat/Exists results for; 0 disables all caching, List included" releaseDefault:"5m" devDefault:"5m"`
+	CertStorageCacheListTTL    time.Duration `help:"how long to cache --certstorage-url List results for; 0 reuses --certstorage-cache-ttl" releaseDefault:"30s" devDefault:"30s"`
+	CertStorageCacheMaxEntries int           `help:"maximum entries kept in each --certstorage-url cache; 0 means unbounded" releaseDefault:"1000" devDefault:"1000"`
+
+	NonInteractive bool `help:"don't prompt for input during setup" releaseDefault:"false" devDefault:"false" setup:"true"`
+
 	Config
 }
 
+// splitDomains parses a comma-separated --domain-name value into individual
+// domain suffixes, trimming surrounding whitespace so a value like
+// "example.com, *.example.com" doesn't produce an entry with a leading
+// space.
+func splitDomains(domainName string) []string {
+	parts := strings.Split(domainName, ",")
+	domains := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if p = strings.TrimSpace(p); p != "" {
+			domains = append(domains, p)
+		}
+	}
+	return domains
+}
+
+// newCertStorage builds the certmagic.Storage backend selected by
+// CertStorageURL, reading the GCS JSON key or S3 credentials it needs from
+// the corresponding flags.
+func (flags GatewayFlags) newCertStorage(ctx context.Context) (certmagic.Storage, error) {
+	var jsonKey []byte
+	if flags.CertStorageGCSJSONKeyPath != "" {
+		var err error
+		jsonKey, err = os.ReadFile(flags.CertStorageGCSJSONKeyPath)
+		if err != nil {
+			return nil, Error.Wrap(err)
+		}
+	}
+
+	storage, err := certstorage.Open(ctx, zap.L(), flags.CertStorageURL, certstorage.Secrets{
+		GCSJSONKey:        jsonKey,
+		S3AccessKeyID:     flags.CertStorageS3AccessKeyID,
+		S3SecretAccessKey: flags.CertStorageS3SecretKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if flags.CertStorageEncryptionKey != "" {
+		encrypter, err := flags.newCertStorageEncrypter()
+		if err != nil {
+			return nil, err
+		}
+		switch s := storage.(type) {
+		case *certstorage.GCS:
+			s.Encrypter = encrypter
+		case *certstorage.S3:
+			s.Encrypter = encrypter
+		}
+	}
+
+	return storage, nil
+}
+
+// newCertStorageEncrypter builds the Encrypter to use for --certstorage-url
+// from CertStorageEncryptionKey, a hex-encoded 32-byte AES-256 key supplied
+// directly from config rather than a KMS service.
+func (flags GatewayFlags) newCertStorageEncrypter() (*certstorage.Encrypter, error) {
+	key, err := hex.DecodeString(flags.CertStorageEncryptionKey)
+	if err != nil {
+		return nil, Error.Wrap(err)
+	}
+	if len(key) != 32 {
+		return nil, Error.New("--certstorage-encryption-key must be a 32-byte hex-encoded key (64 hex characters), got %d bytes", len(key))
+	}
+
+	var staticKey [32]byte
+	copy(staticKey[:], key)
+
+	return &certstorage.Encrypter{Keys: certstorage.StaticKeySource{Key: staticKey}}, nil
+}
+
+// certStorageTLSConfig builds a *tls.Config that serves certificates out of
+// the CertStorageURL backend instead of the CertDir directory, so operators
+// pointed at gs://, s3://, or any other registered scheme don't also need a
+// local certs directory.
+func (flags GatewayFlags) certStorageTLSConfig(ctx context.Context) (*tls.Config, error) {
+	storage, err := flags.newCertStorage(ctx)
+	if err != nil {
+		return nil, Error.Wrap(err)
+	}
+
+	if flags.CertStorageCacheTTL > 0 {
+		listTTL := flags.CertStorageCacheListTTL
+		if listTTL <= 0 {
+			listTTL = flags.CertStorageCacheTTL
+		}
+		storage = certstorage.NewCached(storage, certstorage.CacheOptions{
+			TTL:        flags.CertStorageCacheTTL,
+			ListTTL:    listTTL,
+			MaxEntries: flags.CertStorageCacheMaxEntries,
+		})
+	}
+
+	magic := certmagic.NewDefault()
+	magic.Storage = storage
+
+	return magic.TLSConfig(), nil
+}
+
 // ClientConfig is a configuration struct for the uplink that controls how
 // to talk to the rest of the network.
 type ClientConfig struct {
@@ -68,7 +182,15 @@ var (
 		Short: "Run the classic S3-compatible gateway",
 		RunE:  cmdRun,
 	}
-	runCfg GatewayFlags
+	setupCmd = &cobra.Command{
+		Use:         "setup",
+		Short:       "Create a gateway config file",
+		RunE:        cmdSetup,
+		Args:        cobra.NoArgs,
+		Annotations: map[string]string{"type": "setup"},
+	}
+	runCfg   GatewayFlags
+	setupCfg GatewayFlags
 
 	confDir string
 )
@@ -79,7 +201,9 @@ func init() {
 	defaults := cfgstruct.DefaultsFlag(rootCmd)
 
 	rootCmd.AddCommand(runCmd)
+	rootCmd.AddCommand(setupCmd)
 	process.Bind(runCmd, &runCfg, defaults, cfgstruct.ConfDir(confDir))
+	process.Bind(setupCmd, &setupCfg, defaults, cfgstruct.ConfDir(confDir), cfgstruct.SetupMode())
 
 	rootCmd.PersistentFlags().BoolVar(new(bool), "advanced", false, "if used in with -h, print advanced flags help")
 	cfgstruct.SetBoolAnnotation(rootCmd.PersistentFlags(), "advanced", cfgstruct.BasicHelpAnnotationName, true)
@@ -161,13 +285,21 @@ func (flags GatewayFlags) Run(ctx context.Context, address string) (err error) {
 	// because existing configs contain most of these values, we don't have separate
 	// parameter bindings for the non-Minio server
 	var tlsConfig *tls.Config
-	if !runCfg.InsecureDisableTLS {
+	switch {
+	case runCfg.InsecureDisableTLS:
+		// no TLS
+	case runCfg.CertStorageURL != "":
+		tlsConfig, err = runCfg.certStorageTLSConfig(ctx)
+		if err != nil {
+			return err
+		}
+	default:
 		tlsConfig, err = server.LoadTLSConfigFromDir(runCfg.CertDir)
 		if err != nil {
 			return err
 		}
 	}
-	s3 := server.New(listener, zap.L(), tlsConfig, address, strings.Split(runCfg.DomainName, ","))
+	s3 := server.New(listener, zap.L(), tlsConfig, address, splitDomains(runCfg.DomainName))
 	runError := s3.Run(ctx)
 	closeError := s3.Close()
 	return errs.Combine(runError, closeError)
@@ -192,14 +324,15 @@ func (flags *GatewayFlags) newUplinkConfig(ctx context.Context) uplink.Config {
 	return config
 }
 
-/*	`setUsageFunc` is a bit unconventional but cobra didn't leave much room for
-	extensibility here. `cmd.SetUsageTemplate` is fairly useless for our case without
-	the ability to add to the template's function map (see: https://golang.org/pkg/text/template/#hdr-Functions).
+/*
+`setUsageFunc` is a bit unconventional but cobra didn't leave much room for
+extensibility here. `cmd.SetUsageTemplate` is fairly useless for our case without
+the ability to add to the template's function map (see: https://golang.org/pkg/text/template/#hdr-Functions).
 
-	Because we can't alter what `cmd.Usage` generates, we have to edit it afterwards.
-	In order to hook this function *and* get the usage string, we have to juggle the
-	`cmd.usageFunc` between our hook and `nil`, so that we can get the usage string
-	from the default usage func.
+Because we can't alter what `cmd.Usage` generates, we have to edit it afterwards.
+In order to hook this function *and* get the usage string, we have to juggle the
+`cmd.usageFunc` between our hook and `nil`, so that we can get the usage string
+from the default usage func.
 */
 func setUsageFunc(cmd *cobra.Command) {
 	if findBoolFlagEarly("advanced") {
@@ -0,0 +1,262 @@
+// Copyright (C) 2022 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+
+	"storj.io/common/fpath"
+	"storj.io/private/process"
+)
+
+// cmdSetup walks the operator through producing a gateway config.yaml,
+// either interactively or, with --non-interactive, entirely from flags so
+// the same command works in provisioning scripts.
+func cmdSetup(cmd *cobra.Command, args []string) error {
+	setupDir, err := filepath.Abs(confDir)
+	if err != nil {
+		return Error.Wrap(err)
+	}
+
+	valid, _ := fpath.IsValidSetupDir(setupDir)
+	if !valid {
+		return Error.New("gateway configuration already exists (%v)", setupDir)
+	}
+
+	if err := os.MkdirAll(setupDir, 0744); err != nil {
+		return Error.Wrap(err)
+	}
+
+	if setupCfg.NonInteractive {
+		if err := setupCfg.validateNonInteractive(); err != nil {
+			return err
+		}
+	} else if err := setupCfg.interactiveSetup(setupDir); err != nil {
+		return err
+	}
+
+	return process.SaveConfig(cmd, filepath.Join(setupDir, "config.yaml"))
+}
+
+// validateNonInteractive fails fast, rather than letting `run` discover it
+// later, if a value the setup command needs in non-interactive mode wasn't
+// passed as a flag.
+func (flags *GatewayFlags) validateNonInteractive() error {
+	var missing []string
+	require := func(value, flag string) {
+		if value == "" {
+			missing = append(missing, flag)
+		}
+	}
+
+	require(flags.AuthURL, "auth-url")
+	require(flags.AuthToken, "auth-token")
+	require(flags.DomainName, "domain-name")
+	if !flags.InsecureDisableTLS {
+		require(flags.CertDir, "cert-dir")
+	}
+
+	if len(missing) > 0 {
+		return Error.New("missing required flags for non-interactive setup: --%s", strings.Join(missing, ", --"))
+	}
+	return nil
+}
+
+// interactiveSetup prompts the operator for everything validateNonInteractive
+// would otherwise require as flags, validating each answer as it's given.
+func (flags *GatewayFlags) interactiveSetup(setupDir string) error {
+	reader := bufio.NewReader(os.Stdin)
+
+	fmt.Printf("Configuring gateway in %s\n\n", setupDir)
+
+	for {
+		authURL, err := promptString(reader, "Auth Service URL", flags.AuthURL)
+		if err != nil {
+			return err
+		}
+		if err := pingAuthURL(authURL); err != nil {
+			fmt.Printf("Could not reach %s: %v. Try again? [Y/n] ", authURL, err)
+			if answer, _ := reader.ReadString('\n'); strings.HasPrefix(strings.ToLower(strings.TrimSpace(answer)), "n") {
+				return Error.New("auth service URL %q is unreachable", authURL)
+			}
+			continue
+		}
+		flags.AuthURL = authURL
+		break
+	}
+
+	fmt.Print("Auth Service security token: ")
+	token, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err != nil {
+		return Error.Wrap(err)
+	}
+	if strings.TrimSpace(string(token)) == "" {
+		return Error.New("an auth service security token is required")
+	}
+	flags.AuthToken = strings.TrimSpace(string(token))
+
+	domainName, err := promptString(reader, "Domain suffix(es) to serve on (comma-separated)", flags.DomainName)
+	if err != nil {
+		return err
+	}
+	if len(splitDomains(domainName)) == 0 {
+		return Error.New("at least one domain suffix is required")
+	}
+	flags.DomainName = domainName
+
+	insecure, err := promptBool(reader, "Disable TLS? (not recommended outside of local development)", flags.InsecureDisableTLS)
+	if err != nil {
+		return err
+	}
+	flags.InsecureDisableTLS = insecure
+
+	if !flags.InsecureDisableTLS {
+		certDir, err := promptString(reader, "Directory to generate/store TLS certificates in", filepath.Join(setupDir, "certs"))
+		if err != nil {
+			return err
+		}
+		flags.CertDir = certDir
+
+		generate, err := promptBool(reader, fmt.Sprintf("Generate a self-signed certificate into %s now?", certDir), true)
+		if err != nil {
+			return err
+		}
+		if generate {
+			if err := generateSelfSignedCert(certDir, splitDomains(flags.DomainName)); err != nil {
+				return Error.Wrap(err)
+			}
+			fmt.Printf("Wrote a self-signed certificate to %s\n", certDir)
+		}
+	}
+
+	return nil
+}
+
+func promptString(reader *bufio.Reader, prompt, defaultValue string) (string, error) {
+	if defaultValue != "" {
+		fmt.Printf("%s [%s]: ", prompt, defaultValue)
+	} else {
+		fmt.Printf("%s: ", prompt)
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", Error.Wrap(err)
+	}
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return defaultValue, nil
+	}
+	return line, nil
+}
+
+func promptBool(reader *bufio.Reader, prompt string, defaultValue bool) (bool, error) {
+	hint := "Y/n"
+	if !defaultValue {
+		hint = "y/N"
+	}
+	fmt.Printf("%s [%s]: ", prompt, hint)
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return false, Error.Wrap(err)
+	}
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "":
+		return defaultValue, nil
+	case "y", "yes":
+		return true, nil
+	case "n", "no":
+		return false, nil
+	default:
+		return false, Error.New("please answer y or n")
+	}
+}
+
+// pingAuthURL does a best-effort reachability check so a typo in the Auth
+// Service URL is caught during setup rather than on the first TLS handshake.
+func pingAuthURL(authURL string) error {
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// generateSelfSignedCert writes a self-signed, 1-year-valid certificate and
+// key for domains into certDir/gateway.crt and certDir/gateway.key, good
+// enough for local development where a real ACME-issued certificate isn't
+// available. These share the "gateway" basename deliberately: run loads
+// certDir through server.LoadTLSConfigFromDir, and a mismatched pair of
+// basenames would leave the self-signed cert silently unused.
+func generateSelfSignedCert(certDir string, domains []string) error {
+	if err := os.MkdirAll(certDir, 0744); err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{Organization: []string{"Storj Gateway (self-signed)"}},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     domains,
+		IsCA:         true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	certOut, err := os.OpenFile(filepath.Join(certDir, "gateway.crt"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = certOut.Close() }()
+	if err := pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+		return err
+	}
+
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	keyOut, err := os.OpenFile(filepath.Join(certDir, "gateway.key"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = keyOut.Close() }()
+	return pem.Encode(keyOut, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes})
+}
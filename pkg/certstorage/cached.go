@@ -0,0 +1,305 @@
+// Copyright (C) 2022 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package certstorage
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/spacemonkeygo/monkit/v3"
+	"golang.org/x/sync/singleflight"
+)
+
+// CacheOptions configures a new Cached.
+type CacheOptions struct {
+	// TTL is how long Load, Stat and Exists results are cached for. It must
+	// be positive: lruCache.set stamps a new entry's expiry as
+	// time.Now().Add(ttl), so a zero TTL would store every entry already
+	// expired and the cache would silently never hit. Callers that want
+	// caching disabled should not construct a Cached at all rather than
+	// pass a zero TTL.
+	TTL time.Duration
+	// ListTTL is how long List results are cached for. It's tracked
+	// separately from TTL since a directory listing tends to go stale
+	// faster than any one certificate's contents. Subject to the same
+	// positive-value requirement as TTL.
+	ListTTL time.Duration
+	// MaxEntries bounds each of the four caches independently; the least
+	// recently used entry is evicted once a cache would grow past it. Zero
+	// means unbounded.
+	MaxEntries int
+}
+
+// Cached wraps a certmagic.Storage, memoizing Load, Stat, Exists and List so
+// that every TLS handshake certmagic drives doesn't have to round-trip to
+// the backing store. Store and Delete invalidate the affected key. Misses
+// for the same key that land concurrently are coalesced with singleflight,
+// so a thundering herd of lookups for the same SNI produces a single
+// backend fetch.
+type Cached struct {
+	inner certmagic.Storage
+
+	load   *lruCache[string, cachedResult[[]byte]]
+	stat   *lruCache[string, cachedResult[certmagic.KeyInfo]]
+	exists *lruCache[string, bool]
+	list   *lruCache[listCacheKey, []string]
+
+	group singleflight.Group
+}
+
+type listCacheKey struct {
+	prefix    string
+	recursive bool
+}
+
+// cachedResult records either a successful Load/Stat result or the fact
+// that the key didn't exist, so a repeated lookup for a certificate that
+// hasn't been issued yet doesn't have to hit the backend either. Any other
+// error is never cached.
+type cachedResult[V any] struct {
+	value    V
+	notFound bool
+}
+
+// NewCached returns a Cached wrapping inner.
+func NewCached(inner certmagic.Storage, opts CacheOptions) *Cached {
+	return &Cached{
+		inner: inner,
+
+		load:   newLRUCache[string, cachedResult[[]byte]](opts.TTL, opts.MaxEntries),
+		stat:   newLRUCache[string, cachedResult[certmagic.KeyInfo]](opts.TTL, opts.MaxEntries),
+		exists: newLRUCache[string, bool](opts.TTL, opts.MaxEntries),
+		list:   newLRUCache[listCacheKey, []string](opts.ListTTL, opts.MaxEntries),
+	}
+}
+
+var _ certmagic.Storage = (*Cached)(nil) // make sure Cached implements certmagic.Storage
+
+// Lock implements certmagic's Storage interface by delegating to inner;
+// locks aren't cacheable.
+func (c *Cached) Lock(ctx context.Context, name string) error { return c.inner.Lock(ctx, name) }
+
+// Unlock implements certmagic's Storage interface by delegating to inner.
+func (c *Cached) Unlock(ctx context.Context, name string) error { return c.inner.Unlock(ctx, name) }
+
+// Store implements certmagic's Storage interface, invalidating key's cache
+// entries on success.
+func (c *Cached) Store(ctx context.Context, key string, value []byte) error {
+	if err := c.inner.Store(ctx, key, value); err != nil {
+		return err
+	}
+	c.invalidate(key)
+	return nil
+}
+
+// Delete implements certmagic's Storage interface, invalidating key's cache
+// entries on success.
+func (c *Cached) Delete(ctx context.Context, key string) error {
+	if err := c.inner.Delete(ctx, key); err != nil {
+		return err
+	}
+	c.invalidate(key)
+	return nil
+}
+
+// invalidate drops key's Load/Stat/Exists entries and clears the List
+// cache entirely, since there's no cheap way to tell which cached listings
+// key would have shown up in.
+func (c *Cached) invalidate(key string) {
+	c.load.delete(key)
+	c.stat.delete(key)
+	c.exists.delete(key)
+	c.list.clear()
+}
+
+// Load implements certmagic's Storage interface.
+func (c *Cached) Load(ctx context.Context, key string) (_ []byte, err error) {
+	defer mon.Task()(&ctx)(&err)
+
+	if cached, ok := c.load.get(key); ok {
+		mon.Event("certstorage_cache", monkit.NewSeriesTag("hit", "true"), monkit.NewSeriesTag("op", "load"))
+		if cached.notFound {
+			return nil, fs.ErrNotExist
+		}
+		return cached.value, nil
+	}
+	mon.Event("certstorage_cache", monkit.NewSeriesTag("hit", "false"), monkit.NewSeriesTag("op", "load"))
+
+	v, err, _ := c.group.Do("load:"+key, func() (interface{}, error) {
+		return c.inner.Load(ctx, key)
+	})
+	switch {
+	case err == nil:
+		value := v.([]byte)
+		c.load.set(key, cachedResult[[]byte]{value: value})
+		return value, nil
+	case errors.Is(err, fs.ErrNotExist):
+		c.load.set(key, cachedResult[[]byte]{notFound: true})
+		return nil, err
+	default:
+		return nil, err
+	}
+}
+
+// Stat implements certmagic's Storage interface.
+func (c *Cached) Stat(ctx context.Context, key string) (_ certmagic.KeyInfo, err error) {
+	defer mon.Task()(&ctx)(&err)
+
+	if cached, ok := c.stat.get(key); ok {
+		mon.Event("certstorage_cache", monkit.NewSeriesTag("hit", "true"), monkit.NewSeriesTag("op", "stat"))
+		if cached.notFound {
+			return certmagic.KeyInfo{}, fs.ErrNotExist
+		}
+		return cached.value, nil
+	}
+	mon.Event("certstorage_cache", monkit.NewSeriesTag("hit", "false"), monkit.NewSeriesTag("op", "stat"))
+
+	v, err, _ := c.group.Do("stat:"+key, func() (interface{}, error) {
+		return c.inner.Stat(ctx, key)
+	})
+	switch {
+	case err == nil:
+		info := v.(certmagic.KeyInfo)
+		c.stat.set(key, cachedResult[certmagic.KeyInfo]{value: info})
+		return info, nil
+	case errors.Is(err, fs.ErrNotExist):
+		c.stat.set(key, cachedResult[certmagic.KeyInfo]{notFound: true})
+		return certmagic.KeyInfo{}, err
+	default:
+		return certmagic.KeyInfo{}, err
+	}
+}
+
+// Exists implements certmagic's Storage interface.
+func (c *Cached) Exists(ctx context.Context, key string) bool {
+	var err error
+	defer mon.Task()(&ctx)(&err)
+
+	if value, ok := c.exists.get(key); ok {
+		mon.Event("certstorage_cache", monkit.NewSeriesTag("hit", "true"), monkit.NewSeriesTag("op", "exists"))
+		return value
+	}
+	mon.Event("certstorage_cache", monkit.NewSeriesTag("hit", "false"), monkit.NewSeriesTag("op", "exists"))
+
+	v, _, _ := c.group.Do("exists:"+key, func() (interface{}, error) {
+		return c.inner.Exists(ctx, key), nil
+	})
+	value := v.(bool)
+	c.exists.set(key, value)
+	return value
+}
+
+// List implements certmagic's Storage interface.
+func (c *Cached) List(ctx context.Context, prefix string, recursive bool) (_ []string, err error) {
+	defer mon.Task()(&ctx)(&err)
+	key := listCacheKey{prefix: prefix, recursive: recursive}
+
+	if value, ok := c.list.get(key); ok {
+		mon.Event("certstorage_cache", monkit.NewSeriesTag("hit", "true"), monkit.NewSeriesTag("op", "list"))
+		return value, nil
+	}
+	mon.Event("certstorage_cache", monkit.NewSeriesTag("hit", "false"), monkit.NewSeriesTag("op", "list"))
+
+	v, err, _ := c.group.Do(fmt.Sprintf("list:%s:%t", prefix, recursive), func() (interface{}, error) {
+		return c.inner.List(ctx, prefix, recursive)
+	})
+	if err != nil {
+		return nil, err
+	}
+	value := v.([]string)
+	c.list.set(key, value)
+	return value, nil
+}
+
+// lruCache is a fixed-capacity, TTL-expiring LRU cache.
+type lruCache[K comparable, V any] struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	maxLen  int
+	entries map[K]*list.Element
+	order   *list.List
+}
+
+type lruNode[K comparable, V any] struct {
+	key       K
+	value     V
+	expiresAt time.Time
+}
+
+func newLRUCache[K comparable, V any](ttl time.Duration, maxLen int) *lruCache[K, V] {
+	return &lruCache[K, V]{
+		ttl:     ttl,
+		maxLen:  maxLen,
+		entries: make(map[K]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (c *lruCache[K, V]) get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	node := el.Value.(*lruNode[K, V])
+	if time.Now().After(node.expiresAt) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		var zero V
+		return zero, false
+	}
+	c.order.MoveToFront(el)
+	return node.value, true
+}
+
+func (c *lruCache[K, V]) set(key K, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expiresAt := time.Now().Add(c.ttl)
+	if el, ok := c.entries[key]; ok {
+		el.Value.(*lruNode[K, V]).value = value
+		el.Value.(*lruNode[K, V]).expiresAt = expiresAt
+		c.order.MoveToFront(el)
+		return
+	}
+
+	el := c.order.PushFront(&lruNode[K, V]{key: key, value: value, expiresAt: expiresAt})
+	c.entries[key] = el
+
+	if c.maxLen > 0 {
+		for c.order.Len() > c.maxLen {
+			oldest := c.order.Back()
+			c.order.Remove(oldest)
+			delete(c.entries, oldest.Value.(*lruNode[K, V]).key)
+		}
+	}
+}
+
+func (c *lruCache[K, V]) delete(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.order.Remove(el)
+		delete(c.entries, key)
+	}
+}
+
+func (c *lruCache[K, V]) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[K]*list.Element)
+	c.order.Init()
+}
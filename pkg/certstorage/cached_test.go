@@ -0,0 +1,183 @@
+package certstorage
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+type countingStorage struct {
+	certmagic.Storage
+
+	mu     sync.Mutex
+	loads  int32
+	values map[string][]byte
+	delay  time.Duration
+}
+
+func newCountingStorage() *countingStorage {
+	return &countingStorage{values: make(map[string][]byte)}
+}
+
+func (c *countingStorage) Store(ctx context.Context, key string, value []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] = value
+	return nil
+}
+
+func (c *countingStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	atomic.AddInt32(&c.loads, 1)
+	if c.delay > 0 {
+		time.Sleep(c.delay)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.values[key]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return v, nil
+}
+
+func (c *countingStorage) Delete(ctx context.Context, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.values, key)
+	return nil
+}
+
+func TestCachedLoadHitsOnlyOnce(t *testing.T) {
+	ctx := context.Background()
+	inner := newCountingStorage()
+	if err := inner.Store(ctx, "a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewCached(inner, CacheOptions{TTL: time.Minute, ListTTL: time.Minute})
+	for i := 0; i < 3; i++ {
+		v, err := c.Load(ctx, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(v) != "1" {
+			t.Fatalf("got %q", v)
+		}
+	}
+	if got := atomic.LoadInt32(&inner.loads); got != 1 {
+		t.Fatalf("expected 1 backend load, got %d", got)
+	}
+}
+
+func TestCachedTTLExpiry(t *testing.T) {
+	ctx := context.Background()
+	inner := newCountingStorage()
+	if err := inner.Store(ctx, "a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewCached(inner, CacheOptions{TTL: 10 * time.Millisecond, ListTTL: time.Minute})
+	if _, err := c.Load(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, err := c.Load(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&inner.loads); got != 2 {
+		t.Fatalf("expected 2 backend loads after expiry, got %d", got)
+	}
+}
+
+func TestCachedStoreDeleteInvalidate(t *testing.T) {
+	ctx := context.Background()
+	inner := newCountingStorage()
+	if err := inner.Store(ctx, "a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewCached(inner, CacheOptions{TTL: time.Minute, ListTTL: time.Minute})
+	if _, err := c.Load(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Store(ctx, "a", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	v, err := c.Load(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "2" {
+		t.Fatalf("expected invalidated cache to reload, got %q", v)
+	}
+
+	if err := c.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Load(ctx, "a"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected fs.ErrNotExist after delete, got %v", err)
+	}
+}
+
+func TestCachedLRUEviction(t *testing.T) {
+	ctx := context.Background()
+	inner := newCountingStorage()
+	for _, k := range []string{"a", "b", "c"} {
+		if err := inner.Store(ctx, k, []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := NewCached(inner, CacheOptions{TTL: time.Minute, ListTTL: time.Minute, MaxEntries: 2})
+	for _, k := range []string{"a", "b"} {
+		if _, err := c.Load(ctx, k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Loading "c" should evict the least recently used entry, "a".
+	if _, err := c.Load(ctx, "c"); err != nil {
+		t.Fatal(err)
+	}
+
+	before := atomic.LoadInt32(&inner.loads)
+	if _, err := c.Load(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&inner.loads) != before+1 {
+		t.Fatal("expected \"a\" to have been evicted, causing a backend load")
+	}
+}
+
+func TestCachedSingleflightCoalescesMisses(t *testing.T) {
+	ctx := context.Background()
+	inner := newCountingStorage()
+	inner.delay = 20 * time.Millisecond
+	if err := inner.Store(ctx, "a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewCached(inner, CacheOptions{TTL: time.Minute, ListTTL: time.Minute})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.Load(ctx, "a"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&inner.loads); got != 1 {
+		t.Fatalf("expected concurrent misses to coalesce into 1 backend load, got %d", got)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"context"
 	"io"
 	"io/fs"
+	"net/http"
 	"strconv"
 	"strings"
 	"sync"
@@ -39,6 +40,11 @@ type GCS struct {
 
 	locks map[string]*gcslock.Mutex
 	mu    sync.Mutex
+
+	// Encrypter, if set, transparently encrypts values on Store and decrypts
+	// them on Load, so certificate private keys are never written to GCS in
+	// the clear.
+	Encrypter *Encrypter
 }
 
 // NewGCS returns initialized GCS.
@@ -114,7 +120,17 @@ func (gcs *GCS) Store(ctx context.Context, key string, value []byte) error {
 	k := gcs.prefix + key
 	gcs.logger.Debug("store", zap.String("bucket", gcs.bucket), zap.String("key", k))
 
-	return Error.Wrap(gcs.client.Upload(ctx, nil, gcs.bucket, k, bytes.NewReader(value)))
+	var headers http.Header
+	if gcs.Encrypter != nil {
+		encrypted, headerLen, err := gcs.Encrypter.Encrypt(ctx, k, value)
+		if err != nil {
+			return Error.Wrap(err)
+		}
+		value = encrypted
+		headers = http.Header{gcsMetaHeader(cseHeaderLenMetadataKey): []string{strconv.Itoa(headerLen)}}
+	}
+
+	return Error.Wrap(gcs.client.Upload(ctx, headers, gcs.bucket, k, bytes.NewReader(value)))
 }
 
 // Load implements certmagics's Storage interface.
@@ -133,7 +149,28 @@ func (gcs *GCS) Load(ctx context.Context, key string) (_ []byte, err error) {
 	}
 	defer func() { err = Error.Wrap(errs.Combine(err, rc.Close())) }()
 
-	return io.ReadAll(rc)
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, Error.Wrap(err)
+	}
+
+	if gcs.Encrypter != nil {
+		data, err = gcs.Encrypter.Decrypt(ctx, k, data)
+		if err != nil {
+			if errs.Is(err, errUnrecognizedHeader) {
+				return nil, Error.Wrap(fs.ErrNotExist)
+			}
+			return nil, Error.Wrap(err)
+		}
+	}
+
+	return data, nil
+}
+
+// gcsMetaHeader turns a custom metadata key into the GCS object-metadata
+// request/response header name it's exposed under.
+func gcsMetaHeader(key string) string {
+	return "X-Goog-Meta-" + key
 }
 
 // Delete implements certmagics's Storage interface.
@@ -201,5 +238,15 @@ func (gcs *GCS) Stat(ctx context.Context, key string) (_ certmagic.KeyInfo, err
 		return keyInfo, Error.Wrap(err)
 	}
 
+	if gcs.Encrypter != nil {
+		if raw := headers.Get(gcsMetaHeader(cseHeaderLenMetadataKey)); raw != "" {
+			headerLen, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				return keyInfo, Error.Wrap(err)
+			}
+			keyInfo.Size = plaintextSize(keyInfo.Size, headerLen)
+		}
+	}
+
 	return keyInfo, nil
 }
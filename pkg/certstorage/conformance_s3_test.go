@@ -0,0 +1,62 @@
+// Copyright (C) 2022 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+//go:build integration
+
+package certstorage
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// TestConformanceS3 runs the certmagic.Storage conformance suite against a
+// real s3:// backend. Unlike Memory and File, S3 talks to a concrete
+// s3ops.Client with no fake seam to substitute in unit tests, so this needs a
+// real (or MinIO) bucket and credentials. It's gated behind the "integration"
+// build tag and the CERTSTORAGE_TEST_S3_URL environment variable, so
+// `go test ./...` doesn't require network access or cloud credentials to
+// pass; `go test -tags integration ./...` skips it the same way unless the
+// environment is configured.
+//
+// Run it with, e.g.:
+//
+//	CERTSTORAGE_TEST_S3_URL='s3://bucket/prefix?endpoint=http://localhost:9000&insecure=true' \
+//	CERTSTORAGE_TEST_S3_ACCESS_KEY_ID=minioadmin \
+//	CERTSTORAGE_TEST_S3_SECRET_KEY=minioadmin \
+//	go test -tags integration ./pkg/certstorage/... -run TestConformanceS3
+func TestConformanceS3(t *testing.T) {
+	rawURL := os.Getenv("CERTSTORAGE_TEST_S3_URL")
+	if rawURL == "" {
+		t.Skip("CERTSTORAGE_TEST_S3_URL not set")
+	}
+
+	opts, err := ParseS3URL(rawURL)
+	if err != nil {
+		t.Fatalf("ParseS3URL: %v", err)
+	}
+	opts.AccessKeyID = os.Getenv("CERTSTORAGE_TEST_S3_ACCESS_KEY_ID")
+	opts.SecretAccessKey = os.Getenv("CERTSTORAGE_TEST_S3_SECRET_KEY")
+	// Give this run its own prefix so it doesn't collide with a concurrent
+	// or previous run's leftover keys.
+	opts.Prefix += "/conformance-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	ctx := context.Background()
+	logger := zap.NewNop()
+
+	a, err := NewS3(ctx, logger, opts)
+	if err != nil {
+		t.Fatalf("NewS3: %v", err)
+	}
+	b, err := NewS3(ctx, logger, opts)
+	if err != nil {
+		t.Fatalf("NewS3: %v", err)
+	}
+
+	testStorageConformance(t, a, b)
+}
@@ -0,0 +1,202 @@
+// Copyright (C) 2022 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package certstorage
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// TestConformanceMemory runs the certmagic.Storage conformance suite against
+// Memory. Since Memory's locks only arbitrate goroutines sharing one value
+// (see its doc comment), lock re-entrancy is exercised against a single
+// shared instance rather than two independently constructed ones.
+func TestConformanceMemory(t *testing.T) {
+	storage := NewMemory()
+	testStorageConformance(t, storage, storage)
+}
+
+// TestConformanceFile runs the certmagic.Storage conformance suite against
+// the file:// backend. Its locking is backed by real files on disk, so,
+// unlike Memory, two independently constructed instances pointed at the same
+// directory do arbitrate against each other the way two different gateway
+// processes sharing a certstorage path would.
+func TestConformanceFile(t *testing.T) {
+	dir := t.TempDir()
+
+	a, err := NewFile("file://" + dir)
+	if err != nil {
+		t.Fatalf("NewFile: %v", err)
+	}
+	b, err := NewFile("file://" + dir)
+	if err != nil {
+		t.Fatalf("NewFile: %v", err)
+	}
+
+	testStorageConformance(t, a, b)
+}
+
+// testStorageConformance exercises the certmagic.Storage contract that
+// certstorage's backends and the gateway's on-demand TLS path both rely on:
+// Stat/Load of a missing key report fs.ErrNotExist, List's recursive and
+// non-recursive semantics match, and Lock provides mutual exclusion. locker
+// and other are two Storage values that back the same underlying location;
+// for backends whose locking only arbitrates within a single instance (e.g.
+// Memory), pass the same value for both.
+//
+// Only Memory and File run here: both are fakeable with nothing more than a
+// temp directory or an in-process map. GCS and S3 talk to concrete
+// gcsops/s3ops clients with no such seam, so running the same contract
+// against them needs a real bucket (or MinIO); see TestConformanceS3, gated
+// behind the "integration" build tag, for that coverage.
+func testStorageConformance(t *testing.T, locker, other certmagic.Storage) {
+	ctx := context.Background()
+
+	t.Run("missing key", func(t *testing.T) {
+		if _, err := locker.Load(ctx, "does-not-exist"); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("Load of missing key: got %v, want fs.ErrNotExist", err)
+		}
+		if _, err := locker.Stat(ctx, "does-not-exist"); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("Stat of missing key: got %v, want fs.ErrNotExist", err)
+		}
+		if locker.Exists(ctx, "does-not-exist") {
+			t.Fatal("Exists of missing key: got true, want false")
+		}
+	})
+
+	t.Run("store, load, stat, delete", func(t *testing.T) {
+		key, value := "a/b/cert.pem", []byte("-----BEGIN CERTIFICATE-----\nfake\n-----END CERTIFICATE-----")
+
+		if err := locker.Store(ctx, key, value); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+		if !locker.Exists(ctx, key) {
+			t.Fatal("Exists after Store: got false, want true")
+		}
+
+		loaded, err := locker.Load(ctx, key)
+		if err != nil {
+			t.Fatalf("Load: %v", err)
+		}
+		if string(loaded) != string(value) {
+			t.Fatalf("Load: got %q, want %q", loaded, value)
+		}
+
+		info, err := locker.Stat(ctx, key)
+		if err != nil {
+			t.Fatalf("Stat: %v", err)
+		}
+		if info.Key != key {
+			t.Fatalf("Stat.Key: got %q, want %q", info.Key, key)
+		}
+		if info.Size != int64(len(value)) {
+			t.Fatalf("Stat.Size: got %d, want %d", info.Size, len(value))
+		}
+		if !info.IsTerminal {
+			t.Fatal("Stat.IsTerminal: got false, want true")
+		}
+
+		if err := locker.Delete(ctx, key); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if locker.Exists(ctx, key) {
+			t.Fatal("Exists after Delete: got true, want false")
+		}
+		if _, err := locker.Load(ctx, key); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("Load after Delete: got %v, want fs.ErrNotExist", err)
+		}
+	})
+
+	t.Run("list recursion", func(t *testing.T) {
+		// Backends are free to represent the "directory" collapsed by a
+		// non-recursive List differently (Memory returns it suffixed with
+		// "/"; certmagic.FileStorage returns the bare directory path), so
+		// this only asserts what certmagic actually relies on: recursive
+		// List reaches every stored key under the prefix, and non-recursive
+		// List doesn't leak any of their full paths.
+		keys := []string{
+			"list/domain-a/cert.pem",
+			"list/domain-a/key.pem",
+			"list/domain-b/cert.pem",
+		}
+		for _, key := range keys {
+			if err := locker.Store(ctx, key, []byte("x")); err != nil {
+				t.Fatalf("Store(%q): %v", key, err)
+			}
+		}
+
+		recursive, err := locker.List(ctx, "list/", true)
+		if err != nil {
+			t.Fatalf("List(recursive): %v", err)
+		}
+		for _, key := range keys {
+			if !contains(recursive, key) {
+				t.Fatalf("List(recursive) = %v, missing %q", recursive, key)
+			}
+		}
+
+		nonRecursive, err := locker.List(ctx, "list/", false)
+		if err != nil {
+			t.Fatalf("List(non-recursive): %v", err)
+		}
+		if len(nonRecursive) == 0 {
+			t.Fatal("List(non-recursive) returned no entries")
+		}
+		for _, key := range keys {
+			if contains(nonRecursive, key) {
+				t.Fatalf("List(non-recursive) = %v, unexpectedly contains full key %q", nonRecursive, key)
+			}
+		}
+	})
+
+	t.Run("lock re-entrancy", func(t *testing.T) {
+		const name = "issuance"
+
+		if err := locker.Lock(ctx, name); err != nil {
+			t.Fatalf("Lock: %v", err)
+		}
+
+		acquired := make(chan struct{})
+		go func() {
+			if err := other.Lock(ctx, name); err != nil {
+				t.Errorf("second Lock: %v", err)
+			}
+			close(acquired)
+		}()
+
+		select {
+		case <-acquired:
+			t.Fatal("second Lock returned before first Unlock")
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		if err := locker.Unlock(ctx, name); err != nil {
+			t.Fatalf("Unlock: %v", err)
+		}
+
+		select {
+		case <-acquired:
+		case <-time.After(10 * time.Second):
+			t.Fatal("second Lock never returned after first Unlock")
+		}
+
+		if err := other.Unlock(ctx, name); err != nil {
+			t.Fatalf("second Unlock: %v", err)
+		}
+	})
+}
+
+func contains(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
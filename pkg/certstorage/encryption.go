@@ -0,0 +1,210 @@
+// Copyright (C) 2022 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package certstorage
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+)
+
+// cseHeaderLenMetadataKey is the custom object-metadata key an encrypting
+// Store writes the header length under, so Stat can report plaintext sizes
+// without downloading and decrypting the whole object.
+const cseHeaderLenMetadataKey = "cse-header-len"
+
+const nonceSize = 12 // AES-256-GCM standard nonce size
+
+// gcmTagSize is the size of the authentication tag AES-256-GCM appends to
+// its ciphertext. Stat needs it in addition to the header length to recover
+// the plaintext size of an encrypted object.
+const gcmTagSize = 16
+
+// encryptionMagic identifies a certstorage-encrypted object. Load treats any
+// object not starting with it, or versioned for a KeySource this Encrypter
+// doesn't have, as unrecognized rather than risking handing certmagic
+// garbage plaintext.
+var encryptionMagic = [4]byte{'C', 'S', 'E', '1'}
+
+const (
+	encryptionVersionStatic byte = 1
+	encryptionVersionKMS    byte = 2
+)
+
+// errUnrecognizedHeader is returned by Encrypter.Decrypt for data that isn't
+// laid out the way Encrypt produces it, or whose authentication tag doesn't
+// check out. GCS.Load and S3.Load both map it to fs.ErrNotExist.
+var errUnrecognizedHeader = Error.New("unrecognized certstorage encryption header")
+
+// KeySource supplies the data encryption key (DEK) an Encrypter uses for a
+// new object, plus however that key is represented at rest so a later Load
+// can recover it again.
+type KeySource interface {
+	// version identifies this source in the object header, so Decrypt can
+	// tell whether it's able to unwrap a given object at all before trying.
+	version() byte
+	// dataKey returns a DEK to use for a new Store, plus its at-rest
+	// representation to persist in the object header.
+	dataKey(ctx context.Context) (dek, wrapped []byte, err error)
+	// unwrap recovers the DEK from the at-rest representation a previous
+	// Store wrote into the object header.
+	unwrap(ctx context.Context, wrapped []byte) (dek []byte, err error)
+}
+
+// StaticKeySource is a KeySource backed by a single 32-byte AES-256 key
+// supplied from config. Nothing needs to be wrapped or stored alongside the
+// ciphertext, since the same key is available again at Load time.
+type StaticKeySource struct {
+	Key [32]byte
+}
+
+func (s StaticKeySource) version() byte { return encryptionVersionStatic }
+
+func (s StaticKeySource) dataKey(context.Context) (dek, wrapped []byte, err error) {
+	return s.Key[:], nil, nil
+}
+
+func (s StaticKeySource) unwrap(context.Context, []byte) ([]byte, error) {
+	return s.Key[:], nil
+}
+
+// KMSClient wraps and unwraps data encryption keys using a key held in a KMS
+// service (GCP KMS, AWS KMS, ...). GenerateDataKey should return a fresh
+// random DEK plus that DEK encrypted under the service's key; Decrypt should
+// reverse it.
+type KMSClient interface {
+	GenerateDataKey(ctx context.Context) (dek, wrapped []byte, err error)
+	Decrypt(ctx context.Context, wrapped []byte) (dek []byte, err error)
+}
+
+// KMSKeySource is a KeySource backed by a KMS-wrapped data key: every object
+// gets its own fresh DEK, itself encrypted by a long-lived key that never
+// leaves the KMS service, with the wrapped DEK stored alongside the
+// ciphertext so Load can ask the KMS to unwrap it again.
+type KMSKeySource struct {
+	Client KMSClient
+}
+
+func (s KMSKeySource) version() byte { return encryptionVersionKMS }
+
+func (s KMSKeySource) dataKey(ctx context.Context) ([]byte, []byte, error) {
+	return s.Client.GenerateDataKey(ctx)
+}
+
+func (s KMSKeySource) unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	return s.Client.Decrypt(ctx, wrapped)
+}
+
+// Encrypter transparently encrypts values written by Store and decrypts
+// values read by Load, using AES-256-GCM with a random nonce per object and
+// the object's key mixed in as additional authenticated data, so a
+// ciphertext copied from one key to another fails to decrypt instead of
+// silently returning the wrong certificate.
+//
+// The object layout Encrypt produces is: magic (4 bytes) | version (1 byte)
+// | wrapped-key-len (4 bytes, big-endian) | wrapped-key | nonce (12 bytes) |
+// AES-256-GCM ciphertext (including its 16-byte tag).
+type Encrypter struct {
+	Keys KeySource
+}
+
+// Encrypt encrypts plaintext for storage under key, returning the full
+// object body to write (header followed by ciphertext) and the length of
+// the header it prepended, so the caller can record it as object metadata
+// for Stat to subtract later.
+func (e *Encrypter) Encrypt(ctx context.Context, key string, plaintext []byte) (body []byte, headerLen int, err error) {
+	dek, wrapped, err := e.Keys.dataKey(ctx)
+	if err != nil {
+		return nil, 0, Error.Wrap(err)
+	}
+
+	gcm, err := newGCM(dek)
+	if err != nil {
+		return nil, 0, Error.Wrap(err)
+	}
+
+	nonce := make([]byte, nonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, 0, Error.Wrap(err)
+	}
+
+	var buf bytes.Buffer
+	buf.Write(encryptionMagic[:])
+	buf.WriteByte(e.Keys.version())
+	if err := binary.Write(&buf, binary.BigEndian, uint32(len(wrapped))); err != nil {
+		return nil, 0, Error.Wrap(err)
+	}
+	buf.Write(wrapped)
+	buf.Write(nonce)
+	headerLen = buf.Len()
+
+	buf.Write(gcm.Seal(nil, nonce, plaintext, []byte(key)))
+
+	return buf.Bytes(), headerLen, nil
+}
+
+// Decrypt reverses Encrypt. It returns errUnrecognizedHeader for any data
+// that isn't in the layout Encrypt produces, that's versioned for a
+// KeySource this Encrypter doesn't have, or whose authentication tag doesn't
+// match key.
+func (e *Encrypter) Decrypt(ctx context.Context, key string, data []byte) ([]byte, error) {
+	const minHeaderLen = 4 + 1 + 4 // magic + version + wrapped-key-len
+	if len(data) < minHeaderLen || !bytes.Equal(data[:4], encryptionMagic[:]) {
+		return nil, errUnrecognizedHeader
+	}
+
+	version := data[4]
+	if version != e.Keys.version() {
+		return nil, errUnrecognizedHeader
+	}
+
+	wrappedLen := int(binary.BigEndian.Uint32(data[5:9]))
+	pos := 9
+	if wrappedLen < 0 || pos+wrappedLen+nonceSize > len(data) {
+		return nil, errUnrecognizedHeader
+	}
+
+	wrapped := data[pos : pos+wrappedLen]
+	pos += wrappedLen
+	nonce := data[pos : pos+nonceSize]
+	pos += nonceSize
+	ciphertext := data[pos:]
+
+	dek, err := e.Keys.unwrap(ctx, wrapped)
+	if err != nil {
+		return nil, Error.Wrap(err)
+	}
+
+	gcm, err := newGCM(dek)
+	if err != nil {
+		return nil, Error.Wrap(err)
+	}
+
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, []byte(key))
+	if err != nil {
+		return nil, errUnrecognizedHeader
+	}
+	return plaintext, nil
+}
+
+// plaintextSize recovers the plaintext size Stat should report for an
+// encrypted object, given its stored size and the header length recorded in
+// its cse-header-len metadata: the stored body is header + AES-GCM(plaintext),
+// and the GCM ciphertext carries a trailing gcmTagSize-byte authentication
+// tag on top of the plaintext.
+func plaintextSize(storedSize, headerLen int64) int64 {
+	return storedSize - headerLen - gcmTagSize
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,34 @@
+// Copyright (C) 2022 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package certstorage
+
+import (
+	"net/url"
+	"path/filepath"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// NewFile returns a certmagic.Storage backed by the local filesystem,
+// rooted at the path given in a file:// URL (e.g. file:///var/lib/gateway/certs
+// or, for a path relative to the working directory, file://certs). It's
+// useful for local development and the conformance test suite; operators
+// wanting durability across machines or processes should use gs:// or s3://
+// instead.
+func NewFile(rawURL string) (certmagic.Storage, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, Error.Wrap(err)
+	}
+	if u.Scheme != "file" {
+		return nil, Error.New("not a file:// URL: %q", rawURL)
+	}
+
+	path := filepath.Join(filepath.FromSlash(u.Host), filepath.FromSlash(u.Path))
+	if path == "" {
+		return nil, Error.New("file URL %q is missing a path", rawURL)
+	}
+
+	return &certmagic.FileStorage{Path: path}, nil
+}
@@ -0,0 +1,165 @@
+// Copyright (C) 2022 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package certstorage
+
+import (
+	"context"
+	"io/fs"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// Memory is an in-memory certmagic.Storage, registered under mem:// so cert
+// issuance flows can be unit-tested without any cloud dependency. It is not
+// safe for use across processes: Lock only arbitrates goroutines sharing one
+// Memory value.
+type Memory struct {
+	mu      sync.Mutex
+	objects map[string]memObject
+	locks   map[string]chan struct{}
+}
+
+type memObject struct {
+	value    []byte
+	modified time.Time
+}
+
+// NewMemory returns an empty Memory.
+func NewMemory() *Memory {
+	return &Memory{
+		objects: make(map[string]memObject),
+		locks:   make(map[string]chan struct{}),
+	}
+}
+
+var _ certmagic.Storage = (*Memory)(nil) // make sure Memory implements certmagic.Storage
+
+// Lock implements certmagic's Storage interface.
+func (m *Memory) Lock(ctx context.Context, name string) error {
+	m.mu.Lock()
+	ch, ok := m.locks[name]
+	if !ok {
+		ch = make(chan struct{}, 1)
+		m.locks[name] = ch
+	}
+	m.mu.Unlock()
+
+	select {
+	case ch <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Unlock implements certmagic's Storage interface.
+func (m *Memory) Unlock(ctx context.Context, name string) error {
+	m.mu.Lock()
+	ch, ok := m.locks[name]
+	m.mu.Unlock()
+	if !ok {
+		return Error.New("mutex for %s not exists", name)
+	}
+
+	select {
+	case <-ch:
+		return nil
+	default:
+		return Error.New("mutex for %s not locked", name)
+	}
+}
+
+// Store implements certmagic's Storage interface.
+func (m *Memory) Store(ctx context.Context, key string, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.objects[key] = memObject{value: append([]byte(nil), value...), modified: time.Now()}
+	return nil
+}
+
+// Load implements certmagic's Storage interface.
+func (m *Memory) Load(ctx context.Context, key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	obj, ok := m.objects[key]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return append([]byte(nil), obj.value...), nil
+}
+
+// Delete implements certmagic's Storage interface.
+func (m *Memory) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.objects[key]; !ok {
+		return fs.ErrNotExist
+	}
+	delete(m.objects, key)
+	return nil
+}
+
+// Exists implements certmagic's Storage interface.
+func (m *Memory) Exists(ctx context.Context, key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.objects[key]
+	return ok
+}
+
+// List implements certmagic's Storage interface.
+func (m *Memory) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	seen := make(map[string]struct{})
+	var keys []string
+	for key := range m.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		entry := key
+		if !recursive {
+			if idx := strings.Index(strings.TrimPrefix(key, prefix), "/"); idx >= 0 {
+				entry = key[:len(prefix)+idx+1]
+			}
+		}
+
+		if _, ok := seen[entry]; ok {
+			continue
+		}
+		seen[entry] = struct{}{}
+		keys = append(keys, entry)
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Stat implements certmagic's Storage interface.
+func (m *Memory) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	obj, ok := m.objects[key]
+	if !ok {
+		return certmagic.KeyInfo{}, fs.ErrNotExist
+	}
+
+	return certmagic.KeyInfo{
+		Key:        key,
+		Modified:   obj.modified,
+		Size:       int64(len(obj.value)),
+		IsTerminal: true,
+	}, nil
+}
@@ -0,0 +1,83 @@
+// Copyright (C) 2022 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package certstorage
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+// Secrets bundles the credentials a registered Factory may need; which
+// fields matter depends on the scheme the factory was Registered under.
+type Secrets struct {
+	GCSJSONKey        []byte
+	S3AccessKeyID     string
+	S3SecretAccessKey string
+}
+
+// Factory constructs a certmagic.Storage for a --certstorage-url whose
+// scheme it was Registered under.
+type Factory func(ctx context.Context, logger *zap.Logger, rawURL string, secrets Secrets) (certmagic.Storage, error)
+
+var (
+	registryMu sync.Mutex
+	registry   = make(map[string]Factory)
+)
+
+// Register adds factory as the constructor for certstorage URLs with the
+// given scheme (without the trailing "://"). Re-registering a scheme
+// replaces its factory, which is mainly useful for tests that want to swap
+// in a fake backend.
+func Register(scheme string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[scheme] = factory
+}
+
+// Open dispatches to the Factory registered for rawURL's scheme, so the
+// gateway can select its certstorage backend with a single
+// --certstorage-url flag. Built in: gs:// (GCS), s3:// (any S3-compatible
+// store), file:// (local filesystem, for dev), and mem:// (in-memory, for
+// tests).
+func Open(ctx context.Context, logger *zap.Logger, rawURL string, secrets Secrets) (certmagic.Storage, error) {
+	scheme, _, found := strings.Cut(rawURL, "://")
+	if !found {
+		return nil, Error.New("certstorage URL %q is missing a scheme", rawURL)
+	}
+
+	registryMu.Lock()
+	factory, ok := registry[scheme]
+	registryMu.Unlock()
+	if !ok {
+		return nil, Error.New("unsupported certstorage URL scheme %q", scheme)
+	}
+
+	storage, err := factory(ctx, logger, rawURL, secrets)
+	return storage, Error.Wrap(err)
+}
+
+func init() {
+	Register("gs", func(ctx context.Context, logger *zap.Logger, rawURL string, secrets Secrets) (certmagic.Storage, error) {
+		_, rest, _ := strings.Cut(rawURL, "://")
+		return NewGCS(ctx, logger, secrets.GCSJSONKey, rest)
+	})
+	Register("s3", func(ctx context.Context, logger *zap.Logger, rawURL string, secrets Secrets) (certmagic.Storage, error) {
+		opts, err := ParseS3URL(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		opts.AccessKeyID, opts.SecretAccessKey = secrets.S3AccessKeyID, secrets.S3SecretAccessKey
+		return NewS3(ctx, logger, opts)
+	})
+	Register("file", func(_ context.Context, _ *zap.Logger, rawURL string, _ Secrets) (certmagic.Storage, error) {
+		return NewFile(rawURL)
+	})
+	Register("mem", func(_ context.Context, _ *zap.Logger, _ string, _ Secrets) (certmagic.Storage, error) {
+		return NewMemory(), nil
+	})
+}
@@ -0,0 +1,289 @@
+// Copyright (C) 2022 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package certstorage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/spacemonkeygo/monkit/v3"
+	"github.com/zeebo/errs"
+	"go.uber.org/zap"
+
+	"storj.io/gateway-mt/pkg/s3lock"
+	"storj.io/gateway-mt/pkg/s3lock/s3ops"
+)
+
+// S3Options configures a new S3.
+type S3Options struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	Endpoint        string
+	Region          string
+	Bucket          string
+	Prefix          string
+
+	// InsecureSkipTLSVerify allows talking to endpoints with self-signed
+	// certificates, e.g. a local MinIO instance used in development.
+	InsecureSkipTLSVerify bool
+}
+
+// S3 implements certmagic's Storage interface on top of any S3-compatible
+// object store (AWS S3, MinIO, Storj's own S3 gateway, ...).
+type S3 struct {
+	logger *zap.Logger
+	client *s3ops.Client
+
+	bucket string
+	prefix string
+
+	locks map[string]*s3lock.Mutex
+	mu    sync.Mutex
+
+	// Encrypter, if set, transparently encrypts values on Store and decrypts
+	// them on Load, so certificate private keys are never written to the
+	// bucket in the clear.
+	Encrypter *Encrypter
+}
+
+// NewS3 returns initialized S3.
+func NewS3(ctx context.Context, logger *zap.Logger, opts S3Options) (_ *S3, err error) {
+	prefix := strings.TrimSuffix(opts.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	s := &S3{
+		logger: logger,
+		bucket: opts.Bucket,
+		prefix: prefix,
+		locks:  make(map[string]*s3lock.Mutex),
+	}
+
+	s.client, err = s3ops.NewClient(ctx, s3ops.Config{
+		AccessKeyID:           opts.AccessKeyID,
+		SecretAccessKey:       opts.SecretAccessKey,
+		Endpoint:              opts.Endpoint,
+		Region:                opts.Region,
+		InsecureSkipTLSVerify: opts.InsecureSkipTLSVerify,
+	})
+	if err != nil {
+		return nil, Error.Wrap(err)
+	}
+
+	if err = s.client.TestPermissions(ctx, s.bucket); err != nil {
+		return nil, Error.Wrap(err)
+	}
+
+	return s, nil
+}
+
+// ParseS3URL parses an `s3://bucket/prefix?endpoint=...&region=...&insecure=true`
+// URL, as accepted by the gateway's --certstorage-url flag, into an S3Options.
+// Credentials are intentionally not part of the URL, since URLs tend to end up
+// in logs and process listings; they must be set on the returned S3Options
+// separately.
+func ParseS3URL(rawURL string) (S3Options, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return S3Options{}, Error.Wrap(err)
+	}
+	if u.Scheme != "s3" {
+		return S3Options{}, Error.New("not an s3:// URL: %q", rawURL)
+	}
+	if u.Host == "" {
+		return S3Options{}, Error.New("s3 URL %q is missing a bucket", rawURL)
+	}
+
+	q := u.Query()
+	return S3Options{
+		Bucket:                u.Host,
+		Prefix:                strings.TrimPrefix(u.Path, "/"),
+		Endpoint:              q.Get("endpoint"),
+		Region:                q.Get("region"),
+		InsecureSkipTLSVerify: q.Get("insecure") == "true",
+	}, nil
+}
+
+var _ certmagic.Storage = (*S3)(nil) // make sure S3 implements certmagic.Storage
+
+// Lock implements certmagic's Storage interface.
+func (s *S3) Lock(ctx context.Context, name string) (err error) {
+	defer mon.Task()(&ctx)(&err)
+
+	s.mu.Lock()
+	lock, ok := s.locks[name]
+	if !ok {
+		m, err := s3lock.NewMutex(ctx, s3lock.Options{
+			Name:   s.prefix + name,
+			Bucket: s.bucket,
+			Logger: s.logger.Named("distributed lock/" + name).Sugar(),
+			Client: s.client,
+		})
+		if err != nil {
+			s.mu.Unlock()
+			return Error.Wrap(err)
+		}
+		s.locks[name], lock = m, m
+	}
+	s.mu.Unlock()
+	mon.Event("certstorage_lockcache", monkit.NewSeriesTag("hit", strconv.FormatBool(ok)))
+	return Error.Wrap(lock.Lock(ctx))
+}
+
+// Unlock implements certmagic's Storage interface.
+func (s *S3) Unlock(ctx context.Context, name string) (err error) {
+	defer mon.Task()(&ctx)(&err)
+
+	s.mu.Lock()
+	lock, ok := s.locks[name]
+	if !ok {
+		s.mu.Unlock()
+		mon.Event("certstorage_mutex_not_exists")
+		return Error.New("mutex for %s not exists", name)
+	}
+	s.mu.Unlock()
+	return Error.Wrap(lock.Unlock(ctx))
+}
+
+// Store implements certmagic's Storage interface.
+func (s *S3) Store(ctx context.Context, key string, value []byte) error {
+	k := s.prefix + key
+	s.logger.Debug("store", zap.String("bucket", s.bucket), zap.String("key", k))
+
+	var metadata map[string]string
+	if s.Encrypter != nil {
+		encrypted, headerLen, err := s.Encrypter.Encrypt(ctx, k, value)
+		if err != nil {
+			return Error.Wrap(err)
+		}
+		value = encrypted
+		metadata = map[string]string{cseHeaderLenMetadataKey: strconv.Itoa(headerLen)}
+	}
+
+	return Error.Wrap(s.client.Upload(ctx, metadata, s.bucket, k, bytes.NewReader(value)))
+}
+
+// Load implements certmagic's Storage interface.
+func (s *S3) Load(ctx context.Context, key string) (_ []byte, err error) {
+	defer mon.Task()(&ctx)(&err)
+	k := s.prefix + key
+
+	s.logger.Debug("load", zap.String("bucket", s.bucket), zap.String("key", k))
+
+	rc, err := s.client.Download(ctx, s.bucket, k)
+	if err != nil {
+		if errs.Is(err, s3ops.ErrNotFound) {
+			return nil, Error.Wrap(fs.ErrNotExist)
+		}
+		return nil, Error.Wrap(err)
+	}
+	defer func() { err = Error.Wrap(errs.Combine(err, rc.Close())) }()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, Error.Wrap(err)
+	}
+
+	if s.Encrypter != nil {
+		data, err = s.Encrypter.Decrypt(ctx, k, data)
+		if err != nil {
+			if errs.Is(err, errUnrecognizedHeader) {
+				return nil, Error.Wrap(fs.ErrNotExist)
+			}
+			return nil, Error.Wrap(err)
+		}
+	}
+
+	return data, nil
+}
+
+// Delete implements certmagic's Storage interface.
+func (s *S3) Delete(ctx context.Context, key string) (err error) {
+	defer mon.Task()(&ctx)(&err)
+	k := s.prefix + key
+
+	s.logger.Debug("delete", zap.String("bucket", s.bucket), zap.String("key", k))
+
+	err = s.client.Delete(ctx, nil, s.bucket, k)
+	if errs.Is(err, s3ops.ErrNotFound) {
+		return Error.Wrap(fs.ErrNotExist)
+	}
+	return Error.Wrap(err)
+}
+
+// Exists implements certmagic's Storage interface.
+func (s *S3) Exists(ctx context.Context, key string) bool {
+	var err error
+	k := s.prefix + key
+
+	defer mon.Task()(&ctx)(&err)
+
+	_, err = s.client.Stat(ctx, s.bucket, k)
+	return err == nil
+}
+
+// List implements certmagic's Storage interface.
+func (s *S3) List(ctx context.Context, prefix string, recursive bool) (_ []string, err error) {
+	defer mon.Task()(&ctx)(&err)
+	p := s.prefix + prefix
+
+	s.logger.Debug("list", zap.String("bucket", s.bucket), zap.String("prefix", p), zap.Bool("recursive", recursive))
+
+	r, err := s.client.List(ctx, s.bucket, p, recursive)
+	for i := range r {
+		r[i] = strings.TrimPrefix(r[i], s.prefix)
+	}
+	return r, Error.Wrap(err)
+}
+
+// Stat implements certmagic's Storage interface.
+func (s *S3) Stat(ctx context.Context, key string) (_ certmagic.KeyInfo, err error) {
+	defer mon.Task()(&ctx)(&err)
+	k := s.prefix + key
+
+	var keyInfo certmagic.KeyInfo
+
+	s.logger.Debug("stat", zap.String("bucket", s.bucket), zap.String("key", k))
+
+	headers, err := s.client.Stat(ctx, s.bucket, k)
+	if err != nil {
+		if errs.Is(err, s3ops.ErrNotFound) {
+			return keyInfo, Error.Wrap(fs.ErrNotExist)
+		}
+		return keyInfo, Error.Wrap(err)
+	}
+
+	keyInfo.Key = key
+	keyInfo.IsTerminal = true // S3 returns 404 if querying prefix
+
+	keyInfo.Modified, err = time.Parse(time.RFC1123, headers.Get("last-modified"))
+	if err != nil {
+		return keyInfo, Error.Wrap(err)
+	}
+	keyInfo.Size, err = strconv.ParseInt(headers.Get("content-length"), 10, 64)
+	if err != nil {
+		return keyInfo, Error.Wrap(err)
+	}
+
+	if s.Encrypter != nil {
+		if raw := headers.Get(s3ops.MetaHeaderPrefix + cseHeaderLenMetadataKey); raw != "" {
+			headerLen, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				return keyInfo, Error.Wrap(err)
+			}
+			keyInfo.Size = plaintextSize(keyInfo.Size, headerLen)
+		}
+	}
+
+	return keyInfo, nil
+}
@@ -0,0 +1,325 @@
+// Copyright (C) 2022 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+// Package s3lock implements a distributed mutex on top of an S3-compatible
+// object store, mirroring the semantics pkg/gcslock provides for GCS.
+package s3lock
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zeebo/errs"
+
+	"storj.io/gateway-mt/pkg/s3lock/s3ops"
+)
+
+// Error is the error class for this package.
+var Error = errs.Class("s3lock")
+
+const (
+	// leaseDuration is how long a held lock is valid for before it is
+	// considered abandoned and may be stolen by another contender.
+	leaseDuration = 30 * time.Second
+	// renewInterval is how often a held lock's lease is refreshed.
+	renewInterval = leaseDuration / 3
+	// acquireRetryInterval is how long to wait between attempts to acquire
+	// a lock that is currently held by someone else.
+	acquireRetryInterval = time.Second
+)
+
+// tokenMetadataKey and expiresMetadataKey are the object-metadata keys the
+// lock object's fencing token and lease deadline are stored under, so every
+// step (acquire, steal, renew, release) can check ownership with a cheap
+// Stat instead of downloading and decoding the object body.
+const (
+	tokenMetadataKey   = "lock-token"
+	expiresMetadataKey = "lock-expires"
+)
+
+// Logger is the minimal logging interface s3lock needs. *zap.SugaredLogger
+// satisfies it.
+type Logger interface {
+	Debugf(template string, args ...interface{})
+	Infof(template string, args ...interface{})
+	Errorf(template string, args ...interface{})
+}
+
+// ObjectStore is the subset of s3ops.Client's operations Mutex needs. It's an
+// interface, rather than a concrete *s3ops.Client, so tests can exercise the
+// locking/fencing logic against a fake backend instead of a real bucket.
+type ObjectStore interface {
+	PutIfAbsent(ctx context.Context, metadata map[string]string, bucket, key string, value io.Reader) error
+	PutIfMatch(ctx context.Context, metadata map[string]string, bucket, key, etag string, value io.Reader) error
+	Stat(ctx context.Context, bucket, key string) (http.Header, error)
+}
+
+// Options configures a new Mutex.
+type Options struct {
+	// Name is the lock's key, unique within Bucket.
+	Name string
+	// Bucket is the bucket the lock object lives in.
+	Bucket string
+	Logger Logger
+	Client ObjectStore
+}
+
+// Mutex is a distributed mutex backed by conditional writes against an
+// S3-compatible bucket. A lock object at Bucket/Name records the current
+// holder's fencing token and lease expiration as object metadata; acquiring
+// the lock means successfully creating that object with `If-None-Match: *`
+// (or, once a held lease has expired, replacing it with an `If-Match` write
+// conditioned on the ETag observed at expiration time), and holding it means
+// periodically renewing it the same way before the lease expires.
+//
+// Every write that changes ownership of the lock object is conditioned on an
+// ETag observed immediately before it, so at most one of any two racing
+// writers can succeed; the loser always sees ErrPreconditionFailed and can
+// tell it does not hold the lock. Renew and Unlock additionally re-read the
+// object's stored fencing token before writing, so a holder whose lease was
+// stolen out from under it (e.g. after a long GC pause) notices rather than
+// renewing or deleting an object it no longer owns.
+//
+// Lock on a Mutex that is already held returns an error instead of waiting,
+// so a single Mutex does not arbitrate between goroutines of one process.
+// certstorage.S3 keeps one Mutex per name, so a second Lock of a name through
+// the same S3 value fails until the first holder calls Unlock.
+type Mutex struct {
+	opts Options
+
+	mu        sync.Mutex
+	held      bool
+	cancelCtx context.CancelFunc
+	lost      chan struct{} // closed if the background renewer gives up the lease
+
+	token uint64 // fencing token of the currently held lease, see newToken
+}
+
+// NewMutex returns a new Mutex for the given options.
+func NewMutex(ctx context.Context, opts Options) (*Mutex, error) {
+	if opts.Client == nil {
+		return nil, Error.New("Client is required")
+	}
+	if opts.Name == "" {
+		return nil, Error.New("Name is required")
+	}
+	return &Mutex{opts: opts}, nil
+}
+
+// lockState is what's recorded in a lock object's metadata: whose fencing
+// token currently holds it and until when.
+type lockState struct {
+	token      uint64
+	expiration int64 // unix nanoseconds
+}
+
+func (s lockState) metadata() map[string]string {
+	return map[string]string{
+		tokenMetadataKey:   strconv.FormatUint(s.token, 10),
+		expiresMetadataKey: strconv.FormatInt(s.expiration, 10),
+	}
+}
+
+// statLock reads the current lock object's state and ETag. found is false,
+// with no error, if no lock object exists yet.
+func statLock(ctx context.Context, client ObjectStore, bucket, name string) (state lockState, etag string, found bool, err error) {
+	headers, err := client.Stat(ctx, bucket, name)
+	if err != nil {
+		if errs.Is(err, s3ops.ErrNotFound) {
+			return lockState{}, "", false, nil
+		}
+		return lockState{}, "", false, err
+	}
+
+	token, err := strconv.ParseUint(headers.Get(s3ops.MetaHeaderPrefix+tokenMetadataKey), 10, 64)
+	if err != nil {
+		return lockState{}, "", false, Error.Wrap(err)
+	}
+	expiration, err := strconv.ParseInt(headers.Get(s3ops.MetaHeaderPrefix+expiresMetadataKey), 10, 64)
+	if err != nil {
+		return lockState{}, "", false, Error.Wrap(err)
+	}
+
+	return lockState{token: token, expiration: expiration}, headers.Get("etag"), true, nil
+}
+
+// Lock acquires the distributed lock, blocking until it is free or ctx is
+// canceled. Once acquired, a background goroutine renews the lease every
+// renewInterval until Unlock is called.
+func (m *Mutex) Lock(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.held {
+		return Error.New("already locked")
+	}
+
+	token, err := m.acquire(ctx)
+	if err != nil {
+		return Error.Wrap(err)
+	}
+
+	renewCtx, cancel := context.WithCancel(context.Background())
+	lost := make(chan struct{})
+	m.token, m.held, m.cancelCtx, m.lost = token, true, cancel, lost
+	go m.renewLoop(renewCtx, token, lost)
+
+	return nil
+}
+
+// acquire creates the lock object with If-None-Match: *, retrying while it
+// exists and is not expired, and stealing it once its lease has lapsed via
+// an If-Match write conditioned on the ETag observed at expiration time, so
+// at most one of several contenders racing to steal it can succeed.
+func (m *Mutex) acquire(ctx context.Context) (uint64, error) {
+	token := newToken()
+
+	for {
+		state := lockState{token: token, expiration: time.Now().Add(leaseDuration).UnixNano()}
+		err := m.opts.Client.PutIfAbsent(ctx, state.metadata(), m.opts.Bucket, m.opts.Name, bytes.NewReader(nil))
+		switch {
+		case err == nil:
+			return token, nil
+		case errs.Is(err, s3ops.ErrPreconditionFailed):
+			if m.tryStealExpired(ctx, token) {
+				return token, nil
+			}
+		default:
+			return 0, err
+		}
+
+		m.opts.Logger.Debugf("lock %s held by another process, retrying", m.opts.Name)
+
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(acquireRetryInterval):
+		}
+	}
+}
+
+// tryStealExpired replaces the lock object with our own fencing token if the
+// current holder's lease has already expired. The replacement is an If-Match
+// write conditioned on the ETag observed just now, so if another contender
+// wins the race and changes the object first, our write fails with
+// ErrPreconditionFailed and we correctly report that the steal did not
+// succeed, rather than both of us believing we hold the lock.
+func (m *Mutex) tryStealExpired(ctx context.Context, token uint64) bool {
+	current, etag, found, err := statLock(ctx, m.opts.Client, m.opts.Bucket, m.opts.Name)
+	if err != nil || !found || time.Now().UnixNano() < current.expiration {
+		return false
+	}
+
+	state := lockState{token: token, expiration: time.Now().Add(leaseDuration).UnixNano()}
+	err = m.opts.Client.PutIfMatch(ctx, state.metadata(), m.opts.Bucket, m.opts.Name, etag, bytes.NewReader(nil))
+	return err == nil
+}
+
+// renewLoop refreshes the lease until ctx is canceled (on Unlock) or the
+// lease is found to have been stolen by another contender, in which case it
+// closes lost so the caller can observe it no longer owns the lock. Every
+// tick re-reads the lock object first, both to obtain the ETag an If-Match
+// renewal needs and to confirm the stored fencing token is still ours: a
+// holder whose lease was already stolen would otherwise keep renewing an
+// object it no longer owns.
+func (m *Mutex) renewLoop(ctx context.Context, token uint64, lost chan struct{}) {
+	ticker := time.NewTicker(renewInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !m.renewOnce(ctx, token) {
+				close(lost)
+				return
+			}
+		}
+	}
+}
+
+// renewOnce performs a single lease-renewal check for token: it re-reads the
+// lock object to confirm token still owns it, then writes a refreshed
+// expiration. It reports whether the lease is still held; renewLoop treats a
+// false result as having lost the lease.
+func (m *Mutex) renewOnce(ctx context.Context, token uint64) bool {
+	current, etag, found, err := statLock(ctx, m.opts.Client, m.opts.Bucket, m.opts.Name)
+	if err != nil {
+		m.opts.Logger.Errorf("failed to renew lock %s: %v", m.opts.Name, err)
+		return false
+	}
+	if !found || current.token != token {
+		m.opts.Logger.Errorf("lost lock %s: stolen by another holder", m.opts.Name)
+		return false
+	}
+
+	state := lockState{token: token, expiration: time.Now().Add(leaseDuration).UnixNano()}
+	if err := m.opts.Client.PutIfMatch(ctx, state.metadata(), m.opts.Bucket, m.opts.Name, etag, bytes.NewReader(nil)); err != nil {
+		m.opts.Logger.Errorf("failed to renew lock %s: %v", m.opts.Name, err)
+		return false
+	}
+	return true
+}
+
+// Unlock releases the distributed lock. It is a no-op error to Unlock a
+// Mutex that was never locked in this process. If the caller's lease had
+// already been stolen, Unlock does nothing further: the lock object belongs
+// to whoever stole it, and only a Stat-verified If-Match write would be safe
+// to issue against it, which is exactly what would fail here anyway.
+func (m *Mutex) Unlock(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.held {
+		return Error.New("not locked")
+	}
+	m.cancelCtx()
+	m.held = false
+
+	select {
+	case <-m.lost:
+		// The lease was already stolen; nothing owned by us remains to release.
+		return nil
+	default:
+	}
+
+	current, etag, found, err := statLock(ctx, m.opts.Client, m.opts.Bucket, m.opts.Name)
+	if err != nil {
+		return Error.Wrap(err)
+	}
+	if !found || current.token != m.token {
+		// Someone else's lease is on record; not ours to touch.
+		return nil
+	}
+
+	// There's no portable conditional delete in the S3 API, so release is
+	// modeled as an If-Match write marking the lease already expired: the
+	// next acquirer's tryStealExpired takes it immediately, and the write is
+	// still conditioned on the ETag we just observed, so it's safe against a
+	// concurrent steal.
+	released := lockState{token: m.token, expiration: 0}
+	if err := m.opts.Client.PutIfMatch(ctx, released.metadata(), m.opts.Bucket, m.opts.Name, etag, bytes.NewReader(nil)); err != nil && !errs.Is(err, s3ops.ErrPreconditionFailed) {
+		return Error.Wrap(err)
+	}
+	return nil
+}
+
+var tokenCounter uint64
+
+// newToken returns a fencing token unique to this process and, within about
+// a millisecond's resolution, increasing over time: a millisecond timestamp
+// in the high bits and a per-process counter in the low 20 bits, which
+// between them won't overflow uint64 for centuries. Lock safety never
+// depends on tokens actually being ordered, though — it comes entirely from
+// the ETag compare-and-swap in acquire/tryStealExpired/renewOnce/Unlock; the
+// token only needs to let statLock tell two leases apart.
+func newToken() uint64 {
+	return uint64(time.Now().UnixMilli())<<20 | (atomic.AddUint64(&tokenCounter, 1) & 0xfffff)
+}
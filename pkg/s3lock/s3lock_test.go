@@ -0,0 +1,233 @@
+// Copyright (C) 2022 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+package s3lock
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"storj.io/gateway-mt/pkg/s3lock/s3ops"
+)
+
+type testLogger struct{}
+
+func (testLogger) Debugf(string, ...interface{}) {}
+func (testLogger) Infof(string, ...interface{})  {}
+func (testLogger) Errorf(string, ...interface{}) {}
+
+// fakeObject is a fake backend's record of a single object's metadata and
+// ETag.
+type fakeObject struct {
+	metadata map[string]string
+	etag     string
+}
+
+// fakeObjectStore is an in-memory ObjectStore, letting tests exercise Mutex's
+// locking/fencing logic without a real bucket.
+type fakeObjectStore struct {
+	mu      sync.Mutex
+	objects map[string]fakeObject
+	nextTag int
+}
+
+func newFakeObjectStore() *fakeObjectStore {
+	return &fakeObjectStore{objects: make(map[string]fakeObject)}
+}
+
+func (f *fakeObjectStore) key(bucket, key string) string { return bucket + "/" + key }
+
+func (f *fakeObjectStore) PutIfAbsent(_ context.Context, metadata map[string]string, bucket, key string, _ io.Reader) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.objects[f.key(bucket, key)]; ok {
+		return s3ops.ErrPreconditionFailed
+	}
+	f.put(bucket, key, metadata)
+	return nil
+}
+
+func (f *fakeObjectStore) PutIfMatch(_ context.Context, metadata map[string]string, bucket, key, etag string, _ io.Reader) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	obj, ok := f.objects[f.key(bucket, key)]
+	if !ok || obj.etag != etag {
+		return s3ops.ErrPreconditionFailed
+	}
+	f.put(bucket, key, metadata)
+	return nil
+}
+
+// put stores metadata under bucket/key with a fresh ETag. Callers must hold f.mu.
+func (f *fakeObjectStore) put(bucket, key string, metadata map[string]string) {
+	f.nextTag++
+	f.objects[f.key(bucket, key)] = fakeObject{
+		metadata: metadata,
+		etag:     strconv.Itoa(f.nextTag),
+	}
+}
+
+func (f *fakeObjectStore) Stat(_ context.Context, bucket, key string) (http.Header, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	obj, ok := f.objects[f.key(bucket, key)]
+	if !ok {
+		return nil, s3ops.ErrNotFound
+	}
+
+	headers := http.Header{}
+	for k, v := range obj.metadata {
+		headers.Set(s3ops.MetaHeaderPrefix+k, v)
+	}
+	headers.Set("etag", obj.etag)
+	return headers, nil
+}
+
+func newTestMutex(t *testing.T, store ObjectStore) *Mutex {
+	t.Helper()
+	m, err := NewMutex(context.Background(), Options{
+		Name:   "lock",
+		Bucket: "bucket",
+		Logger: testLogger{},
+		Client: store,
+	})
+	if err != nil {
+		t.Fatalf("NewMutex: %v", err)
+	}
+	return m
+}
+
+func TestAcquireStealsExpiredLease(t *testing.T) {
+	store := newFakeObjectStore()
+
+	holder := newTestMutex(t, store)
+	if err := holder.Lock(context.Background()); err != nil {
+		t.Fatalf("holder.Lock: %v", err)
+	}
+
+	// Back-date the held lease so the next acquire sees it as already
+	// expired, without waiting out the real leaseDuration.
+	store.mu.Lock()
+	obj := store.objects[store.key("bucket", "lock")]
+	state := lockState{token: holder.token, expiration: time.Now().Add(-time.Second).UnixNano()}
+	obj.metadata = state.metadata()
+	store.objects[store.key("bucket", "lock")] = obj
+	store.mu.Unlock()
+
+	contender := newTestMutex(t, store)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := contender.Lock(ctx); err != nil {
+		t.Fatalf("contender.Lock after expiry: %v", err)
+	}
+	if contender.token == holder.token {
+		t.Fatal("contender stole the lease but kept the same fencing token")
+	}
+}
+
+func TestAcquireDoesNotStealUnexpiredLease(t *testing.T) {
+	store := newFakeObjectStore()
+
+	holder := newTestMutex(t, store)
+	if err := holder.Lock(context.Background()); err != nil {
+		t.Fatalf("holder.Lock: %v", err)
+	}
+
+	contender := newTestMutex(t, store)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := contender.Lock(ctx); err == nil {
+		t.Fatal("contender acquired a lock whose lease had not expired")
+	}
+}
+
+func TestRenewLoopDetectsStolenLease(t *testing.T) {
+	store := newFakeObjectStore()
+
+	holder := newTestMutex(t, store)
+	if err := holder.Lock(context.Background()); err != nil {
+		t.Fatalf("holder.Lock: %v", err)
+	}
+
+	// Simulate another process stealing the lock out from under holder by
+	// overwriting the object with a different fencing token.
+	store.mu.Lock()
+	store.put("bucket", "lock", lockState{token: holder.token + 1, expiration: time.Now().Add(leaseDuration).UnixNano()}.metadata())
+	store.mu.Unlock()
+
+	if holder.renewOnce(context.Background(), holder.token) {
+		t.Fatal("renewOnce reported the lease still held after it was stolen")
+	}
+}
+
+func TestUnlockNoopAfterTheft(t *testing.T) {
+	store := newFakeObjectStore()
+
+	holder := newTestMutex(t, store)
+	if err := holder.Lock(context.Background()); err != nil {
+		t.Fatalf("holder.Lock: %v", err)
+	}
+	holder.cancelCtx() // stop the background renewer so it can't race the steal below
+
+	thief := newTestMutex(t, store)
+	store.mu.Lock()
+	store.put("bucket", "lock", lockState{token: 999, expiration: time.Now().Add(leaseDuration).UnixNano()}.metadata())
+	store.mu.Unlock()
+	thief.token, thief.held = 999, true
+
+	if err := holder.Unlock(context.Background()); err != nil {
+		t.Fatalf("Unlock after theft returned an error: %v", err)
+	}
+
+	headers, err := store.Stat(context.Background(), "bucket", "lock")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if got := headers.Get(s3ops.MetaHeaderPrefix + tokenMetadataKey); got != "999" {
+		t.Fatalf("holder's Unlock touched the thief's lock object; token = %q, want 999", got)
+	}
+}
+
+func TestConcurrentStealOnlyOneWinner(t *testing.T) {
+	store := newFakeObjectStore()
+
+	holder := newTestMutex(t, store)
+	if err := holder.Lock(context.Background()); err != nil {
+		t.Fatalf("holder.Lock: %v", err)
+	}
+	store.mu.Lock()
+	store.put("bucket", "lock", lockState{token: holder.token, expiration: time.Now().Add(-time.Second).UnixNano()}.metadata())
+	store.mu.Unlock()
+
+	const contenders = 10
+	results := make(chan bool, contenders)
+	var wg sync.WaitGroup
+	for i := 0; i < contenders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m := newTestMutex(t, store)
+			results <- m.tryStealExpired(context.Background(), newToken())
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	wins := 0
+	for won := range results {
+		if won {
+			wins++
+		}
+	}
+	if wins != 1 {
+		t.Fatalf("expected exactly 1 contender to win the steal race, got %d", wins)
+	}
+}
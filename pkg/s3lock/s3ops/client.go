@@ -0,0 +1,235 @@
+// Copyright (C) 2022 Storj Labs, Inc.
+// See LICENSE for copying information.
+
+// Package s3ops provides a thin wrapper around an S3-compatible client
+// tailored to the handful of operations certstorage and s3lock need, mirroring
+// the shape of pkg/gcslock/gcsops for GCS.
+package s3ops
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/zeebo/errs"
+)
+
+// Error is the error class for this package.
+var Error = errs.Class("s3ops")
+
+// ErrNotFound is returned when an object or key does not exist.
+var ErrNotFound = errs.New("not found")
+
+// ErrPreconditionFailed is returned when a conditional write loses a race,
+// e.g. an `If-None-Match: *` Put against a key that already exists.
+var ErrPreconditionFailed = errs.New("precondition failed")
+
+// Config configures a new Client.
+type Config struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	Endpoint        string
+	Region          string
+
+	// InsecureSkipTLSVerify allows talking to endpoints with self-signed
+	// certificates, e.g. a local MinIO instance used in development.
+	InsecureSkipTLSVerify bool
+}
+
+// Client wraps an S3 SDK client with the handful of calls certstorage and
+// s3lock need.
+type Client struct {
+	api *s3.Client
+}
+
+// NewClient returns an initialized Client for the given configuration.
+func NewClient(ctx context.Context, cfg Config) (*Client, error) {
+	var httpClient *http.Client
+	if cfg.InsecureSkipTLSVerify {
+		httpClient = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}, //nolint:gosec // opt-in for dev/test endpoints only
+		}
+	}
+
+	awsCfg, err := config.LoadDefaultConfig(ctx,
+		config.WithRegion(cfg.Region),
+		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(cfg.AccessKeyID, cfg.SecretAccessKey, "")),
+		config.WithHTTPClient(httpClient),
+	)
+	if err != nil {
+		return nil, Error.Wrap(err)
+	}
+
+	api := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		if cfg.Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.Endpoint)
+			o.UsePathStyle = true // required by most non-AWS S3-compatible endpoints
+		}
+	})
+
+	return &Client{api: api}, nil
+}
+
+// TestPermissions verifies the client can operate against bucket, failing
+// fast with a descriptive error instead of surfacing confusing errors later.
+func (c *Client) TestPermissions(ctx context.Context, bucket string) error {
+	_, err := c.api.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(bucket)})
+	return Error.Wrap(err)
+}
+
+// Upload uploads value to bucket/key, overwriting any existing object.
+func (c *Client) Upload(ctx context.Context, metadata map[string]string, bucket, key string, value io.Reader) error {
+	_, err := c.api.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		Body:     value,
+		Metadata: metadata,
+	})
+	return Error.Wrap(err)
+}
+
+// PutIfAbsent uploads value to bucket/key only if no object currently exists
+// there, returning ErrPreconditionFailed if one does. This underlies the
+// distributed lock's acquisition step.
+func (c *Client) PutIfAbsent(ctx context.Context, metadata map[string]string, bucket, key string, value io.Reader) error {
+	_, err := c.api.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        value,
+		Metadata:    metadata,
+		IfNoneMatch: aws.String("*"),
+	})
+	if isPreconditionFailed(err) {
+		return ErrPreconditionFailed
+	}
+	return Error.Wrap(err)
+}
+
+// PutIfMatch uploads value to bucket/key only if the object's current ETag
+// equals etag, returning ErrPreconditionFailed if it has since changed (or
+// the object no longer exists). This underlies the distributed lock's
+// compare-and-swap renew/steal/release steps.
+func (c *Client) PutIfMatch(ctx context.Context, metadata map[string]string, bucket, key, etag string, value io.Reader) error {
+	_, err := c.api.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		Body:     value,
+		Metadata: metadata,
+		IfMatch:  aws.String(etag),
+	})
+	if isPreconditionFailed(err) || isNotFound(err) {
+		return ErrPreconditionFailed
+	}
+	return Error.Wrap(err)
+}
+
+// Download returns a reader for bucket/key. The caller must close it.
+func (c *Client) Download(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	out, err := c.api.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, ErrNotFound
+		}
+		return nil, Error.Wrap(err)
+	}
+	return out.Body, nil
+}
+
+// Delete deletes bucket/key.
+func (c *Client) Delete(ctx context.Context, metadata map[string]string, bucket, key string) error {
+	_, err := c.api.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if isNotFound(err) {
+		return ErrNotFound
+	}
+	return Error.Wrap(err)
+}
+
+// Stat returns the headers for bucket/key, emulating the http.Header shape
+// gcsops.Client.Stat returns so certstorage can share Stat parsing logic.
+func (c *Client) Stat(ctx context.Context, bucket, key string) (http.Header, error) {
+	out, err := c.api.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, ErrNotFound
+		}
+		return nil, Error.Wrap(err)
+	}
+
+	headers := make(http.Header)
+	if out.LastModified != nil {
+		headers.Set("last-modified", out.LastModified.Format(http.TimeFormat))
+	}
+	if out.ContentLength != nil {
+		headers.Set("content-length", strconv.FormatInt(*out.ContentLength, 10))
+	}
+	if out.ETag != nil {
+		headers.Set("etag", *out.ETag)
+	}
+	for k, v := range out.Metadata {
+		headers.Set(MetaHeaderPrefix+k, v)
+	}
+	return headers, nil
+}
+
+// MetaHeaderPrefix mirrors the prefix the AWS SDK strips off x-amz-meta-*
+// headers into its Metadata map, so callers can round-trip a custom metadata
+// key through Upload's metadata param and Stat's returned headers without
+// caring about the wire format.
+const MetaHeaderPrefix = "x-amz-meta-"
+
+// List lists keys under bucket/prefix. When recursive is false, only the
+// objects directly under prefix and the immediate "directory" prefixes below
+// it are returned, matching certmagic's List semantics.
+func (c *Client) List(ctx context.Context, bucket, prefix string, recursive bool) ([]string, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}
+	if !recursive {
+		input.Delimiter = aws.String("/")
+	}
+
+	var keys []string
+	paginator := s3.NewListObjectsV2Paginator(c.api, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, Error.Wrap(err)
+		}
+		for _, obj := range page.Contents {
+			keys = append(keys, aws.ToString(obj.Key))
+		}
+		for _, p := range page.CommonPrefixes {
+			keys = append(keys, aws.ToString(p.Prefix))
+		}
+	}
+	return keys, nil
+}
+
+func isNotFound(err error) bool {
+	if err == nil {
+		return false
+	}
+	var nsk *types.NoSuchKey
+	var nf *types.NotFound
+	if errors.As(err, &nsk) || errors.As(err, &nf) {
+		return true
+	}
+	return strings.Contains(err.Error(), "NotFound") || strings.Contains(err.Error(), "NoSuchKey")
+}
+
+func isPreconditionFailed(err error) bool {
+	if err == nil {
+		return false
+	}
+	return strings.Contains(err.Error(), "PreconditionFailed") || strings.Contains(err.Error(), "412")
+}